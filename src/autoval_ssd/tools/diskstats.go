@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolveBlockDevice maps a target path to the whole-device name iostat -x
+// would report, e.g. /dev/nvme0n1p1 -> nvme0n1, /dev/sdb1 -> sdb, or a
+// dm/md device to itself. It does this by following the path's major:minor
+// through /sys/dev/block: a partition's entry has a "partition" attribute
+// and lies inside its disk's directory (.../<disk>/<partition>), so the
+// parent's name is returned; a whole device or dm/md target is returned
+// under its own name.
+func resolveBlockDevice(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+
+	dev := uint64(st.Dev)
+	if st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+		dev = uint64(st.Rdev)
+	}
+	major, minor := unix.Major(dev), unix.Minor(dev)
+
+	link := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(link, "partition")); err == nil {
+		return filepath.Base(filepath.Dir(target)), nil
+	}
+	return filepath.Base(target), nil
+}
+
+// diskStatsSample is one reading of the fields of /proc/diskstats that
+// iostat -x derives its rates from.
+type diskStatsSample struct {
+	ts        time.Time
+	rdIOs     int64
+	wrIOs     int64
+	rdSectors int64
+	wrSectors int64
+	rdTicks   int64
+	wrTicks   int64
+	ioTicks   int64
+}
+
+// readDiskStats returns the current counters for device (e.g. "nvme0n1")
+// from /proc/diskstats.
+func readDiskStats(device string) (*diskStatsSample, error) {
+	f, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 || fields[2] != device {
+			continue
+		}
+		parse := func(i int) int64 {
+			n, _ := strconv.ParseInt(fields[i], 10, 64)
+			return n
+		}
+		return &diskStatsSample{
+			ts:        time.Now(),
+			rdIOs:     parse(3),
+			rdSectors: parse(5),
+			rdTicks:   parse(6),
+			wrIOs:     parse(7),
+			wrSectors: parse(9),
+			wrTicks:   parse(10),
+			ioTicks:   parse(12),
+		}, nil
+	}
+	return nil, fmt.Errorf("device %q not found in /proc/diskstats", device)
+}
+
+// diskStatsSampler periodically reads /proc/diskstats for device and
+// prints the same r/s, w/s, await, svctm, and util% figures as
+// `iostat -x`, so queue saturation (util%~100 with rising await) can be
+// told apart from latency that originates in the device itself.
+func diskStatsSampler(device string) {
+	prev, err := readDiskStats(device)
+	if err != nil {
+		log.Println("diskstats sampler:", err)
+		return
+	}
+
+	for {
+		time.Sleep(time.Second)
+
+		cur, err := readDiskStats(device)
+		if err != nil {
+			log.Println("diskstats sampler:", err)
+			return
+		}
+
+		intervalMs := float64(cur.ts.Sub(prev.ts).Milliseconds())
+		rdIOs := cur.rdIOs - prev.rdIOs
+		wrIOs := cur.wrIOs - prev.wrIOs
+		totalIOs := rdIOs + wrIOs
+		ioTicks := cur.ioTicks - prev.ioTicks
+
+		rPerSec := float64(rdIOs) / (intervalMs / 1000)
+		wPerSec := float64(wrIOs) / (intervalMs / 1000)
+		rMBPerSec := float64(cur.rdSectors-prev.rdSectors) * 512 / (1024 * 1024) / (intervalMs / 1000)
+		wMBPerSec := float64(cur.wrSectors-prev.wrSectors) * 512 / (1024 * 1024) / (intervalMs / 1000)
+
+		var await, svctm float64
+		if totalIOs > 0 {
+			await = float64((cur.rdTicks-prev.rdTicks)+(cur.wrTicks-prev.wrTicks)) / float64(totalIOs)
+			svctm = float64(ioTicks) / float64(totalIOs)
+		}
+
+		util := float64(ioTicks) / intervalMs * 100
+		if util > 100 {
+			util = 100
+		}
+
+		out.writeRecord(record{
+			Time:    time.Now(),
+			Kind:    "diskstats",
+			Device:  device,
+			RPerSec: rPerSec,
+			WPerSec: wPerSec,
+			RMBps:   rMBPerSec,
+			WMBps:   wMBPerSec,
+			AwaitMs: await,
+			SvctmMs: svctm,
+			UtilPct: util,
+		})
+
+		prev = cur
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// histogram is a self-contained HDR-style histogram: values are bucketed
+// on a log-linear scale so that both sub-millisecond and multi-second
+// latencies are tracked in a bounded number of buckets, at the cost of a
+// small relative error within each bucket.
+//
+// Buckets are indexed by (msb(value)<<subBits | subBucket), where msb is
+// the position of the most significant bit of value and subBucket splits
+// each power-of-two range into subCount linear steps. With subBits=3 this
+// gives 8 sub-buckets per doubling, i.e. ~12% worst-case relative error.
+type histogram struct {
+	counts []int64
+}
+
+const subBits = 3
+const subCount = 1 << subBits
+
+// maxTrackable bounds the histogram at one hour of nanoseconds; latencies
+// beyond that collapse into the top bucket.
+const maxTrackable = int64(time.Hour)
+
+var numBuckets = bucketIndex(maxTrackable) + 1
+
+// newHistogram allocates a histogram ready to record into.
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, numBuckets)}
+}
+
+// bucketIndex maps a value in nanoseconds to its bucket.
+func bucketIndex(v int64) int {
+	if v < subCount {
+		return int(v)
+	}
+	msb := bits.Len64(uint64(v)) - 1
+	shift := uint(msb - subBits)
+	return (msb << subBits) | int((v>>shift)&(subCount-1))
+}
+
+// bucketValue returns the representative value (the low edge) of a bucket,
+// the inverse of bucketIndex.
+func bucketValue(idx int) int64 {
+	if idx < subCount {
+		return int64(idx)
+	}
+	msb := idx >> subBits
+	sub := int64(idx & (subCount - 1))
+	shift := uint(msb - subBits)
+	return (sub | subCount) << shift
+}
+
+// record adds a single sample, in nanoseconds, to the histogram. Safe for
+// concurrent use.
+func (h *histogram) record(v int64) {
+	idx := bucketIndex(v)
+	if idx >= len(h.counts) {
+		idx = len(h.counts) - 1
+	}
+	atomic.AddInt64(&h.counts[idx], 1)
+}
+
+// drainInto atomically zeroes h's buckets, adding whatever was in them to
+// each of targets. Used to fold the per-shard histograms into the
+// rolling window and the cumulative summary without a shared lock.
+func (h *histogram) drainInto(targets ...*histogram) {
+	for i := range h.counts {
+		v := atomic.SwapInt64(&h.counts[i], 0)
+		if v == 0 {
+			continue
+		}
+		for _, t := range targets {
+			atomic.AddInt64(&t.counts[i], v)
+		}
+	}
+}
+
+// count returns the total number of samples recorded.
+func (h *histogram) count() int64 {
+	var total int64
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+	}
+	return total
+}
+
+// percentile returns the p-th percentile (0-100) latency recorded.
+func (h *histogram) percentile(p float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100 * float64(total)))
+	var running int64
+	for i := range h.counts {
+		running += atomic.LoadInt64(&h.counts[i])
+		if running >= target {
+			return time.Duration(bucketValue(i))
+		}
+	}
+	return time.Duration(bucketValue(len(h.counts) - 1))
+}
+
+// minMax returns the lowest and highest non-empty buckets' representative
+// values. Both are zero if the histogram is empty.
+func (h *histogram) minMax() (time.Duration, time.Duration) {
+	lo, hi := -1, -1
+	for i := range h.counts {
+		if atomic.LoadInt64(&h.counts[i]) > 0 {
+			if lo == -1 {
+				lo = i
+			}
+			hi = i
+		}
+	}
+	if lo == -1 {
+		return 0, 0
+	}
+	return time.Duration(bucketValue(lo)), time.Duration(bucketValue(hi))
+}
@@ -8,44 +8,207 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-var ioc chan int
-var stats chan time.Duration
 var file *os.File
 var size = flag.Int64("size", 1, "arena size in gigabytes")
 var hz = flag.Float64("rate", 384, "rate in Hz")
 var block = flag.Int64("block", 64, "block size in kilobytes")
-var total int64
-var totalDuration time.Duration
-var maxDuration time.Duration
+var rwmix = flag.Int("rwmix", 0, "percent of IOs that are reads, remainder are writes")
+var pattern = flag.String("pattern", "random", "access pattern: random, sequential, or zipfian")
+var qdepth = flag.Int("qdepth", 1000, "maximum number of outstanding IOs")
+var iosizeDist = flag.String("iosize-dist", "", "weighted block size mix, e.g. 4k:70,64k:20,1m:10 (overrides -block)")
+var listen = flag.String("listen", "", "address to serve Prometheus metrics on, e.g. :9100 (disabled if empty)")
+var metricsNamespace = flag.String("metrics-namespace", "ssdload", "prefix for exported Prometheus metric names")
+var outputFormat = flag.String("output", "human", "record format for per-interval samples and the final summary: human, json, or csv")
+var outputFile = flag.String("output-file", "", "file to write output records to (default stdout)")
+var engine = flag.String("engine", "sync", "IO engine: sync (goroutine-per-IO blocking syscalls) or iouring (single submitter/reaper against the io_uring ring)")
+var sqpoll = flag.Bool("sqpoll", false, "use IORING_SETUP_SQPOLL for kernel-side submission polling (iouring engine only)")
 var maxPending int32
+var maxPendingAll int32
 var pending int32
+var arenaBoundary int64
+var seqPos int64
+var totalBytes int64
+var generatorOverheadLast time.Duration
+var startTime time.Time
 
-func worker() {
-	buf := make([]byte, *block*1024)
-	boundary := *size * 1024 * 1024 * 1024
-	for range ioc {
-		pos := rand.Int63n(boundary/4096) * 4096
-		p := atomic.AddInt32(&pending, 1)
-		if p > maxPending {
-			maxPending = p
+// shards holds one histogram per shard so concurrent IOs record latency
+// without contending on a single set of buckets; the reporter drains them
+// each second. cumulative accumulates across the whole run for the
+// SIGINT summary.
+var shards []*histogram
+var shardSel uint64
+var cumulative = newHistogram()
+
+type ioSize struct {
+	bytes  int64
+	weight int
+}
+
+var ioSizes []ioSize
+var ioSizeWeightTotal int
+
+var zipfMu sync.Mutex
+var zipf *rand.Zipf
+
+// parseSize parses a human block size like "4k", "64k", or "1m" into bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1024
+		s = strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult = 1024 * 1024
+		s = strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		mult = 1024 * 1024 * 1024
+		s = strings.TrimSuffix(s, "g")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// parseIOSizeDist parses a distribution string like "4k:70,64k:20,1m:10"
+// into weighted block sizes. An empty string is not an error; callers fall
+// back to the fixed -block size in that case.
+func parseIOSizeDist(s string) ([]ioSize, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sizes []ioSize
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid iosize-dist entry %q", part)
 		}
-		start := time.Now()
-		_, err := file.WriteAt(buf, pos)
+		bytes, err := parseSize(fields[0])
 		if err != nil {
-			log.Println(err)
+			return nil, fmt.Errorf("invalid iosize-dist entry %q: %v", part, err)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid iosize-dist entry %q: %v", part, err)
+		}
+		sizes = append(sizes, ioSize{bytes: bytes, weight: weight})
+	}
+	return sizes, nil
+}
+
+// pickSize returns the block size in bytes for the next IO, drawn from
+// -iosize-dist if one was given, or the fixed -block size otherwise.
+func pickSize() int64 {
+	if len(ioSizes) == 0 {
+		return *block * 1024
+	}
+	n := rand.Intn(ioSizeWeightTotal)
+	for _, s := range ioSizes {
+		if n < s.weight {
+			return s.bytes
+		}
+		n -= s.weight
+	}
+	return ioSizes[len(ioSizes)-1].bytes
+}
+
+// pickOffset returns the next IO offset, 4096-aligned, according to
+// -pattern. sequential strides by blockSize so it actually sweeps the
+// arena rather than issuing overlapping IOs when blockSize > 4096.
+func pickOffset(blockSize int64) int64 {
+	blocks := arenaBoundary / 4096
+	switch *pattern {
+	case "sequential":
+		stride := (blockSize / 4096) * 4096
+		if stride == 0 {
+			stride = 4096
+		}
+		blocks := arenaBoundary / stride
+		n := atomic.AddInt64(&seqPos, 1) - 1
+		return (n % blocks) * stride
+	case "zipfian":
+		zipfMu.Lock()
+		n := zipf.Uint64()
+		zipfMu.Unlock()
+		return int64(n) * 4096
+	default:
+		return rand.Int63n(blocks) * 4096
+	}
+}
+
+// performIO issues a single read or write chosen by -rwmix, sized by
+// -iosize-dist, and positioned by -pattern, then reports its latency.
+func performIO(sem chan struct{}) {
+	defer func() { <-sem }()
+
+	sz := pickSize()
+	buf := make([]byte, sz)
+	pos := pickOffset(sz)
+
+	p := atomic.AddInt32(&pending, 1)
+	updateMaxPending(p)
+	setPendingMetric(p)
+
+	start := time.Now()
+	var err error
+	op := "write"
+	if rand.Intn(100) < *rwmix {
+		op = "read"
+		_, err = file.ReadAt(buf, pos)
+	} else {
+		_, err = file.WriteAt(buf, pos)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	elapsed := time.Since(start)
+	p = atomic.AddInt32(&pending, -1)
+	setPendingMetric(p)
+	recordLatency(elapsed)
+	recordIOMetric(op, sz, elapsed)
+	atomic.AddInt64(&totalBytes, sz)
+}
+
+// updateMaxPending bumps both the current reporting window's high-water
+// mark and the run-wide one, via compare-and-swap since it is called
+// concurrently from every in-flight IO.
+func updateMaxPending(p int32) {
+	casMax(&maxPending, p)
+	casMax(&maxPendingAll, p)
+}
+
+func casMax(addr *int32, p int32) {
+	for {
+		cur := atomic.LoadInt32(addr)
+		if p <= cur {
+			return
+		}
+		if atomic.CompareAndSwapInt32(addr, cur, p) {
+			return
 		}
-		elapsed := time.Since(start)
-		atomic.AddInt32(&pending, -1)
-		stats <- elapsed
 	}
 }
 
+// recordLatency files a completed IO's latency into one of the shards,
+// chosen round-robin so the hot path never blocks on another IO's write.
+func recordLatency(d time.Duration) {
+	i := atomic.AddUint64(&shardSel, 1) % uint64(len(shards))
+	shards[i].record(int64(d))
+}
+
 func generator() {
+	sem := make(chan struct{}, *qdepth)
+
 	duration := time.Duration(0)
 	if *hz != 0 {
 		duration = time.Second / time.Duration(*hz)
@@ -56,11 +219,19 @@ func generator() {
 	previous := start
 
 	for {
-		ioc <- 1
+		sem <- struct{}{}
+		if *engine == "iouring" {
+			dispatchIOUring(sem)
+		} else {
+			go performIO(sem)
+		}
 
 		elapsed := start.Sub(previous)
 
-		overhead += (elapsed - duration)
+		delta := elapsed - duration
+		overhead += delta
+		recordGeneratorOverheadMetric(delta)
+		generatorOverheadLast = overhead
 
 		if overhead > duration {
 			overhead -= duration
@@ -73,30 +244,45 @@ func generator() {
 	}
 }
 
-func aggregate() {
-	for d := range stats {
-		total++
-		totalDuration += d
-		if maxDuration < d {
-			maxDuration = d
-		}
-	}
-}
-
+// statistics drains the shards into a fresh one-second window each tick,
+// emitting it as an interval record, and folds the same samples into the
+// cumulative histogram for the end-of-run summary.
 func statistics() {
-	last := int64(0)
-	lastDuration := time.Duration(0)
+	var lastBytes int64
 
 	for {
 		time.Sleep(time.Second)
-		sampleDuration := totalDuration - lastDuration
-		if maxDuration > (time.Duration(10)*time.Millisecond) || maxPending > 10 {
-			fmt.Println(time.Now(), " ", maxDuration, sampleDuration/time.Duration(total-last), maxPending)
+
+		window := newHistogram()
+		for _, s := range shards {
+			s.drainInto(window, cumulative)
 		}
-		last = total
-		lastDuration = totalDuration
-		maxDuration = time.Duration(0)
-		maxPending = 0
+
+		curBytes := atomic.LoadInt64(&totalBytes)
+		deltaBytes := curBytes - lastBytes
+		lastBytes = curBytes
+
+		n := window.count()
+		lo, hi := window.minMax()
+		out.writeRecord(record{
+			Time:              time.Now(),
+			Kind:              "interval",
+			Count:             n,
+			Bytes:             deltaBytes,
+			Seconds:           1,
+			IOPS:              float64(n),
+			MBps:              float64(deltaBytes) / (1024 * 1024),
+			MinLatency:        lo,
+			P50Latency:        window.percentile(50),
+			P90Latency:        window.percentile(90),
+			P99Latency:        window.percentile(99),
+			P999Latency:       window.percentile(99.9),
+			P9999Latency:      window.percentile(99.99),
+			MaxLatency:        hi,
+			MaxPending:        atomic.LoadInt32(&maxPending),
+			GeneratorOverhead: generatorOverheadLast,
+		})
+		atomic.StoreInt32(&maxPending, 0)
 	}
 }
 
@@ -107,21 +293,80 @@ func init() {
 
 func main() {
 	var err error
-	ioc = make(chan int, 10000)
-	stats = make(chan time.Duration, 100)
 	flag.Parse()
+	startTime = time.Now()
+
+	out = newOutputWriter()
+	out.writeFlags()
+
+	ioSizes, err = parseIOSizeDist(*iosizeDist)
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range ioSizes {
+		ioSizeWeightTotal += s.weight
+	}
+
+	arenaBoundary = *size * 1024 * 1024 * 1024
+	if *pattern == "zipfian" {
+		zipf = rand.NewZipf(rand.New(rand.NewSource(time.Now().UnixNano())), 1.1, 1, uint64(arenaBoundary/4096-1))
+	}
+
+	shards = make([]*histogram, runtime.NumCPU())
+	for i := range shards {
+		shards[i] = newHistogram()
+	}
+
+	initMetrics()
+
 	file, err = os.OpenFile(flag.Arg(0), syscall.O_DIRECT|os.O_RDWR, 0)
 	if err != nil {
 		panic(err)
 	}
-	for i := 0; i < 1000; i++ {
-		go worker()
+
+	if *engine == "iouring" {
+		uring, err = newIOUringEngine(int(file.Fd()), *qdepth)
+		if err != nil {
+			panic(err)
+		}
+		uring.run()
 	}
-	go aggregate()
+
+	if device, err := resolveBlockDevice(flag.Arg(0)); err != nil {
+		log.Println("diskstats sampler disabled:", err)
+	} else {
+		go diskStatsSampler(device)
+	}
+
 	go generator()
 	go statistics()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
-	// panic("interrupted")
+
+	for _, s := range shards {
+		s.drainInto(cumulative)
+	}
+	elapsed := time.Since(startTime).Seconds()
+	n := cumulative.count()
+	bytes := atomic.LoadInt64(&totalBytes)
+	lo, hi := cumulative.minMax()
+	out.writeRecord(record{
+		Time:              time.Now(),
+		Kind:              "summary",
+		Count:             n,
+		Bytes:             bytes,
+		Seconds:           elapsed,
+		IOPS:              float64(n) / elapsed,
+		MBps:              float64(bytes) / (1024 * 1024) / elapsed,
+		MinLatency:        lo,
+		P50Latency:        cumulative.percentile(50),
+		P90Latency:        cumulative.percentile(90),
+		P99Latency:        cumulative.percentile(99),
+		P999Latency:       cumulative.percentile(99.9),
+		P9999Latency:      cumulative.percentile(99.99),
+		MaxLatency:        hi,
+		MaxPending:        atomic.LoadInt32(&maxPendingAll),
+		GeneratorOverhead: generatorOverheadLast,
+	})
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// latencyBuckets spans the range SSD IOs actually live in: 50us tail
+// latency up to a 5s worst case, rather than Prometheus's HTTP-oriented
+// defaults.
+var latencyBuckets = []float64{
+	0.00005, 0.0001, 0.0002, 0.0005,
+	0.001, 0.002, 0.005, 0.01, 0.02, 0.05,
+	0.1, 0.2, 0.5, 1, 2, 5,
+}
+
+var (
+	iosTotal          *prometheus.CounterVec
+	bytesTotal        prometheus.Counter
+	pendingGauge      prometheus.Gauge
+	latencySeconds    prometheus.Histogram
+	generatorOverhead prometheus.Histogram
+)
+
+// initMetrics registers the exported counters/histograms and starts the
+// /metrics server when -listen is set. It is a no-op otherwise, and the
+// record*Metric helpers below check for that case so the hot path never
+// has to branch on whether metrics are enabled.
+func initMetrics() {
+	if *listen == "" {
+		return
+	}
+
+	iosTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Name:      "ios_total",
+		Help:      "Total IOs issued, by operation.",
+	}, []string{"op"})
+	bytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Name:      "bytes_total",
+		Help:      "Total bytes transferred.",
+	})
+	pendingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "pending",
+		Help:      "Number of IOs currently outstanding.",
+	})
+	latencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: *metricsNamespace,
+		Name:      "latency_seconds",
+		Help:      "Observed IO latency in seconds.",
+		Buckets:   latencyBuckets,
+	})
+	generatorOverhead = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: *metricsNamespace,
+		Name:      "generator_overhead_seconds",
+		Help:      "Generator pacing overhead, i.e. how far behind the requested rate it has fallen.",
+		Buckets:   latencyBuckets,
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(iosTotal, bytesTotal, pendingGauge, latencySeconds, generatorOverhead)
+	reg.MustRegister(collectors.NewGoCollector())
+	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(*listen, mux); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func recordIOMetric(op string, bytes int64, elapsed time.Duration) {
+	if iosTotal == nil {
+		return
+	}
+	iosTotal.WithLabelValues(op).Inc()
+	bytesTotal.Add(float64(bytes))
+	latencySeconds.Observe(elapsed.Seconds())
+}
+
+func setPendingMetric(p int32) {
+	if pendingGauge == nil {
+		return
+	}
+	pendingGauge.Set(float64(p))
+}
+
+func recordGeneratorOverheadMetric(d time.Duration) {
+	if generatorOverhead == nil {
+		return
+	}
+	generatorOverhead.Observe(d.Seconds())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// record is one emitted sample: a per-second IO "interval" window, the
+// end-of-run "summary", or a "diskstats" sample. The same shape is used
+// for all three so that external tooling parsing -output json/csv only
+// has to handle one schema, switching on Kind.
+type record struct {
+	Time              time.Time     `json:"time"`
+	Kind              string        `json:"kind"`
+	Count             int64         `json:"count"`
+	Bytes             int64         `json:"bytes"`
+	Seconds           float64       `json:"seconds"`
+	IOPS              float64       `json:"iops"`
+	MBps              float64       `json:"mbps"`
+	MinLatency        time.Duration `json:"min_latency_ns"`
+	P50Latency        time.Duration `json:"p50_latency_ns"`
+	P90Latency        time.Duration `json:"p90_latency_ns"`
+	P99Latency        time.Duration `json:"p99_latency_ns"`
+	P999Latency       time.Duration `json:"p999_latency_ns"`
+	P9999Latency      time.Duration `json:"p9999_latency_ns"`
+	MaxLatency        time.Duration `json:"max_latency_ns"`
+	MaxPending        int32         `json:"max_pending"`
+	GeneratorOverhead time.Duration `json:"generator_overhead_ns"`
+
+	// Diskstats-only fields, populated when Kind == "diskstats".
+	Device  string  `json:"device"`
+	RPerSec float64 `json:"r_per_sec"`
+	WPerSec float64 `json:"w_per_sec"`
+	RMBps   float64 `json:"r_mbps"`
+	WMBps   float64 `json:"w_mbps"`
+	AwaitMs float64 `json:"await_ms"`
+	SvctmMs float64 `json:"svctm_ms"`
+	UtilPct float64 `json:"util_pct"`
+}
+
+// outputWriter serializes records and the startup flag dump as
+// -output human|json|csv to stdout or -output-file.
+type outputWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    string
+	csvHeader bool
+}
+
+var out *outputWriter
+
+func newOutputWriter() *outputWriter {
+	w := io.Writer(os.Stdout)
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			panic(err)
+		}
+		w = f
+	}
+	return &outputWriter{w: w, format: *outputFormat}
+}
+
+const csvHeaderLine = "time,kind,count,bytes,seconds,iops,mbps,min_ns,p50_ns,p90_ns,p99_ns,p999_ns,p9999_ns,max_ns,max_pending,generator_overhead_ns,device,r_per_sec,w_per_sec,r_mbps,w_mbps,await_ms,svctm_ms,util_pct"
+
+func (o *outputWriter) writeRecord(r record) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch o.format {
+	case "json":
+		b, _ := json.Marshal(r)
+		fmt.Fprintln(o.w, string(b))
+	case "csv":
+		if !o.csvHeader {
+			fmt.Fprintln(o.w, csvHeaderLine)
+			o.csvHeader = true
+		}
+		fmt.Fprintf(o.w, "%s,%s,%d,%d,%.3f,%.1f,%.2f,%d,%d,%d,%d,%d,%d,%d,%d,%d,%s,%.1f,%.1f,%.2f,%.2f,%.2f,%.2f,%.1f\n",
+			r.Time.Format(time.RFC3339), r.Kind, r.Count, r.Bytes, r.Seconds, r.IOPS, r.MBps,
+			r.MinLatency, r.P50Latency, r.P90Latency, r.P99Latency, r.P999Latency, r.P9999Latency,
+			r.MaxLatency, r.MaxPending, r.GeneratorOverhead,
+			r.Device, r.RPerSec, r.WPerSec, r.RMBps, r.WMBps, r.AwaitMs, r.SvctmMs, r.UtilPct)
+	default:
+		if r.Kind == "diskstats" {
+			fmt.Fprintf(o.w, "%s %s r/s=%.1f w/s=%.1f rMB/s=%.2f wMB/s=%.2f await=%.2fms svctm=%.2fms util=%.1f%%\n",
+				r.Time.Format(time.RFC3339), r.Device, r.RPerSec, r.WPerSec, r.RMBps, r.WMBps, r.AwaitMs, r.SvctmMs, r.UtilPct)
+			return
+		}
+		fmt.Fprintf(o.w, "%s %s n=%d bytes=%d iops=%.1f mbps=%.2f min=%s p50=%s p90=%s p99=%s p99.9=%s p99.99=%s max=%s maxPending=%d overhead=%s\n",
+			r.Time.Format(time.RFC3339), r.Kind, r.Count, r.Bytes, r.IOPS, r.MBps,
+			r.MinLatency, r.P50Latency, r.P90Latency, r.P99Latency, r.P999Latency, r.P9999Latency,
+			r.MaxLatency, r.MaxPending, r.GeneratorOverhead)
+	}
+}
+
+// writeFlags dumps the effective flag values once at startup, so a run
+// recorded via -output-file is self-describing.
+func (o *outputWriter) writeFlags() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch o.format {
+	case "json":
+		flags := map[string]string{}
+		flag.VisitAll(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+		b, _ := json.Marshal(map[string]interface{}{"kind": "flags", "flags": flags})
+		fmt.Fprintln(o.w, string(b))
+	case "csv":
+		flag.VisitAll(func(f *flag.Flag) { fmt.Fprintf(o.w, "# %s=%s\n", f.Name, f.Value.String()) })
+	default:
+		fmt.Fprintln(o.w, "effective flags:")
+		flag.VisitAll(func(f *flag.Flag) { fmt.Fprintf(o.w, "  -%s=%s\n", f.Name, f.Value.String()) })
+	}
+}